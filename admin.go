@@ -0,0 +1,163 @@
+package integram
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminJobsPathPrefix is the path AdminHandler is mounted under, e.g. in services.go's init via
+// INTEGRAM_ADMIN_ADDR, or by a host process embedding it in its own mux.
+const adminJobsPathPrefix = "/_admin/services/"
+
+// adminToken authenticates every admin API request, read once from INTEGRAM_ADMIN_TOKEN. This is a
+// job control plane (it can retry/cancel arbitrary jobs), so unlike the Redis-backed checks
+// elsewhere in the package it fails closed: with no token configured, every request is rejected
+// rather than served unauthenticated.
+var adminToken = os.Getenv("INTEGRAM_ADMIN_TOKEN")
+
+func checkAdminToken(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) == 1
+}
+
+// AdminHandler serves the persisted job state for every registered service as JSON, for operational
+// introspection and control. Every request must carry "Authorization: Bearer <INTEGRAM_ADMIN_TOKEN>";
+// set that env var before mounting this handler, it is never served unauthenticated:
+//
+//	GET  /_admin/services/{name}/jobs              list jobs, optionally filtered by ?state=
+//	GET  /_admin/services/{name}/jobs/{id}         fetch one job's current state and transition history
+//	POST /_admin/services/{name}/jobs/{id}/retry   re-enqueue a failed/dead job
+//	POST /_admin/services/{name}/jobs/{id}/cancel  mark a failed job Dead without re-enqueueing it
+type AdminHandler struct{}
+
+func (AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(r) {
+		if adminToken == "" {
+			log.Warn("INTEGRAM_ADMIN_TOKEN is not set, rejecting admin API request. Set it to enable the admin API.")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, adminJobsPathPrefix)
+	if rest == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if len(parts) < 2 || parts[1] != "jobs" {
+		http.NotFound(w, r)
+		return
+	}
+
+	service, err := serviceByName(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	store := service.JobStore()
+
+	switch len(parts) {
+	case 2: // /services/{name}/jobs
+		serveJobsList(w, r, store)
+	case 3: // /services/{name}/jobs/{id}
+		serveJobGet(w, store, parts[2])
+	case 4: // /services/{name}/jobs/{id}/retry|cancel
+		switch parts[3] {
+		case "retry":
+			serveJobRetry(w, r, store, parts[2])
+		case "cancel":
+			serveJobCancel(w, r, store, parts[2])
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveJobsList(w http.ResponseWriter, r *http.Request, store *JobStore) {
+	state := JobState(-1)
+	if stateParam := r.URL.Query().Get("state"); stateParam != "" {
+		found := false
+		for s := JobPending; s <= JobDead; s++ {
+			if s.String() == stateParam {
+				state = s
+				found = true
+				break
+			}
+		}
+		if !found {
+			http.Error(w, "unknown state "+stateParam, http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := store.List(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, records)
+}
+
+// jobDetail is the admin-facing view of a single job: its current record plus its full, append-only
+// transition history.
+type jobDetail struct {
+	*JobStateRecord
+	History []JobStateRecord `json:"history"`
+}
+
+func serveJobGet(w http.ResponseWriter, store *JobStore, id string) {
+	record, err := store.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	history, err := store.History(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, jobDetail{JobStateRecord: record, History: history})
+}
+
+func serveJobRetry(w http.ResponseWriter, r *http.Request, store *JobStore, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := store.Retry(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeAdminJSON(w, map[string]string{"id": job.Id(), "status": JobScheduled.String()})
+}
+
+func serveJobCancel(w http.ResponseWriter, r *http.Request, store *JobStore, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := store.Cancel(id); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeAdminJSON(w, map[string]string{"id": id, "status": JobDead.String()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
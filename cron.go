@@ -0,0 +1,151 @@
+package integram
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/robfig/cron"
+)
+
+// cronLockTTL is how long, in seconds, a cron lock is held. The lock is never released explicitly,
+// it only expires, so a Unique job fires at most once per cronLockTTL window across the cluster.
+const cronLockTTL = 60
+
+var redisPool *redis.Pool
+
+func init() {
+	redisURL := os.Getenv("INTEGRAM_REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://127.0.0.1:6379"
+	}
+
+	redisPool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(redisURL)
+		},
+	}
+}
+
+// cronLockKey is the Redis key used to make sure only one clustered Integram instance fires a given cron job
+func cronLockKey(serviceName string, jobName string) string {
+	return fmt.Sprintf("integram:cron_lock:%s:%s", serviceName, jobName)
+}
+
+// acquireCronLock tries to take the cron lock for this tick. Returns true if this instance should
+// run the job: either it won the lock, or Redis couldn't be reached at all. Failing open on a
+// Redis outage risks an occasional double-fire, which beats the alternative of a Redis outage
+// silently and permanently starving every Unique cron job cluster-wide.
+func acquireCronLock(serviceName string, jobName string) bool {
+	c := redisPool.Get()
+	defer c.Close()
+
+	reply, err := redis.String(c.Do("SET", cronLockKey(serviceName, jobName), "1", "NX", "EX", cronLockTTL))
+	if err != nil {
+		if err == redis.ErrNil {
+			return false
+		}
+		log.WithFields(log.Fields{"service": serviceName, "job": jobName}).WithError(err).Warn("Can't reach Redis for cron lock, running the tick anyway (failing open)")
+		return true
+	}
+	return reply == "OK"
+}
+
+// cronEntry tracks the live schedule for one service+job cron goroutine, so RescheduleCron can
+// update it in place without restarting the goroutine or losing its place in the tick loop.
+type cronEntry struct {
+	mu       sync.Mutex
+	schedule cron.Schedule
+	resched  chan cron.Schedule
+}
+
+func (e *cronEntry) current() cron.Schedule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.schedule
+}
+
+func (e *cronEntry) set(schedule cron.Schedule) {
+	e.mu.Lock()
+	e.schedule = schedule
+	e.mu.Unlock()
+}
+
+var cronEntriesMu sync.Mutex
+var cronEntries = make(map[string]*cronEntry)
+
+func cronEntryKey(serviceName string, jobName string) string {
+	return serviceName + "/" + jobName
+}
+
+// runServiceCron starts one ticker goroutine per scheduled Job of the service. It runs for the lifetime of the process.
+func runServiceCron(service *Service) {
+	for _, job := range service.Jobs {
+		if job.Schedule == "" {
+			continue
+		}
+
+		schedule, err := cron.Parse(job.Schedule)
+		if err != nil {
+			log.WithField("service", service.Name).WithError(err).Errorf("Can't parse cron schedule %q", job.Schedule)
+			continue
+		}
+
+		jobName := getFuncName(job.HandlerFunc)
+		entry := &cronEntry{schedule: schedule, resched: make(chan cron.Schedule, 1)}
+
+		cronEntriesMu.Lock()
+		cronEntries[cronEntryKey(service.Name, jobName)] = entry
+		cronEntriesMu.Unlock()
+
+		go func(job Job, jobName string, entry *cronEntry) {
+			for {
+				now := time.Now()
+				next := entry.current().Next(now)
+
+				select {
+				case newSchedule := <-entry.resched:
+					entry.set(newSchedule)
+					continue
+				case <-time.After(next.Sub(now)):
+				}
+
+				if job.Unique && !acquireCronLock(service.Name, jobName) {
+					log.WithFields(log.Fields{"service": service.Name, "job": jobName}).Debug("Cron lock held elsewhere, skipping tick")
+					continue
+				}
+
+				if _, err := service.DoJob(job.HandlerFunc); err != nil {
+					log.WithFields(log.Fields{"service": service.Name, "job": jobName}).WithError(err).Error("Can't schedule cron job")
+				}
+			}
+		}(job, jobName, entry)
+	}
+}
+
+// RescheduleCron updates the cron schedule for a job that was registered with Schedule set,
+// without restarting the service. It returns an error if the job has no running cron goroutine
+// to update, e.g. it was never given a Schedule at Register time.
+func (s *Service) RescheduleCron(handlerFunc interface{}, spec string) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("RescheduleCron: can't parse schedule %q: %v", spec, err)
+	}
+
+	jobName := getFuncName(handlerFunc)
+
+	cronEntriesMu.Lock()
+	entry, ok := cronEntries[cronEntryKey(s.Name, jobName)]
+	cronEntriesMu.Unlock()
+	if !ok {
+		return fmt.Errorf("RescheduleCron: %s/%s has no running cron schedule to update", s.Name, jobName)
+	}
+
+	entry.resched <- schedule
+	return nil
+}
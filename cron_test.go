@@ -0,0 +1,68 @@
+package integram
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/robfig/cron"
+)
+
+func TestCronLockKey(t *testing.T) {
+	got := cronLockKey("github", "SyncIssues")
+	want := "integram:cron_lock:github:SyncIssues"
+	if got != want {
+		t.Fatalf("cronLockKey() = %q, want %q", got, want)
+	}
+}
+
+func TestAcquireCronLockFailsOpenOnRedisError(t *testing.T) {
+	original := redisPool
+	defer func() { redisPool = original }()
+
+	redisPool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, errors.New("redis unreachable")
+		},
+	}
+
+	if !acquireCronLock("github", "SyncIssues") {
+		t.Fatal("acquireCronLock() = false on Redis error, want true (fail open)")
+	}
+}
+
+func TestRescheduleCronUnknownJob(t *testing.T) {
+	s := &Service{Name: "unregistered-test-service"}
+	if err := s.RescheduleCron(func() {}, "@every 1m"); err == nil {
+		t.Fatal("RescheduleCron() on a job with no running schedule: got nil error, want one")
+	}
+}
+
+func TestRescheduleCronUpdatesRunningEntry(t *testing.T) {
+	schedule, err := cron.Parse("@every 1h")
+	if err != nil {
+		t.Fatalf("cron.Parse() error = %v", err)
+	}
+	entry := &cronEntry{schedule: schedule, resched: make(chan cron.Schedule, 1)}
+
+	s := &Service{Name: "reschedule-test-service"}
+	handlerFunc := func() {}
+	jobName := getFuncName(handlerFunc)
+
+	cronEntriesMu.Lock()
+	cronEntries[cronEntryKey(s.Name, jobName)] = entry
+	cronEntriesMu.Unlock()
+
+	if err := s.RescheduleCron(handlerFunc, "@every 5m"); err != nil {
+		t.Fatalf("RescheduleCron() error = %v", err)
+	}
+
+	select {
+	case newSchedule := <-entry.resched:
+		if newSchedule == nil {
+			t.Fatal("RescheduleCron() sent a nil schedule")
+		}
+	default:
+		t.Fatal("RescheduleCron() didn't push a new schedule onto the entry's channel")
+	}
+}
@@ -0,0 +1,82 @@
+package integram
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// insecureServicesAllowList is the set of service names allowed to set InsecureSkipVerify,
+// populated from INTEGRAM_INSECURE_SERVICES (comma separated) at package init and checked when
+// Register builds the service's HTTP client
+var insecureServicesAllowList = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Split(os.Getenv("INTEGRAM_INSECURE_SERVICES"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			insecureServicesAllowList[name] = true
+		}
+	}
+}
+
+// buildHTTPClient constructs the *http.Client a service should use for all outbound requests
+// (OAuth token exchange, webhook callbacks, API calls), honoring its TLS and proxy settings.
+func buildHTTPClient(service *Service) (*http.Client, error) {
+	if !service.InsecureSkipVerify && len(service.CACertPEM) == 0 && len(service.ClientCertPEM) == 0 && service.HTTPProxy == "" {
+		return http.DefaultClient, nil
+	}
+
+	if service.InsecureSkipVerify && !insecureServicesAllowList[service.Name] {
+		return nil, fmt.Errorf("service %s sets InsecureSkipVerify but is not listed in INTEGRAM_INSECURE_SERVICES", service.Name)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: service.InsecureSkipVerify}
+
+	if len(service.CACertPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(service.CACertPEM) {
+			return nil, fmt.Errorf("service %s: can't parse CACertPEM", service.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(service.ClientCertPEM) > 0 || len(service.ClientKeyPEM) > 0 {
+		cert, err := tls.X509KeyPair(service.ClientCertPEM, service.ClientKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: can't load client cert/key: %v", service.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+
+	if service.HTTPProxy != "" {
+		proxyURL, err := url.Parse(service.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: can't parse HTTPProxy: %v", service.Name, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// HTTPClient returns the *http.Client configured for this service's TLS/proxy settings, building
+// and caching it on first use. Use it instead of http.DefaultClient for any outbound request
+// the service's handlers make.
+func (s *Service) HTTPClient() *http.Client {
+	if s.httpClient == nil {
+		client, err := buildHTTPClient(s)
+		if err != nil {
+			s.Log().WithError(err).Error("Can't build service HTTP client, falling back to http.DefaultClient")
+			return http.DefaultClient
+		}
+		s.httpClient = client
+	}
+	return s.httpClient
+}
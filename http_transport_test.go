@@ -0,0 +1,49 @@
+package integram
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBuildHTTPClientDefaultsToDefaultClient(t *testing.T) {
+	client, err := buildHTTPClient(&Service{Name: "plain"})
+	if err != nil {
+		t.Fatalf("buildHTTPClient() error = %v", err)
+	}
+	if client != http.DefaultClient {
+		t.Fatal("buildHTTPClient() with no TLS/proxy settings should return http.DefaultClient")
+	}
+}
+
+func TestBuildHTTPClientRejectsInsecureSkipVerifyWithoutAllowList(t *testing.T) {
+	delete(insecureServicesAllowList, "not-allow-listed")
+
+	_, err := buildHTTPClient(&Service{Name: "not-allow-listed", InsecureSkipVerify: true})
+	if err == nil {
+		t.Fatal("buildHTTPClient() with InsecureSkipVerify outside the allow-list: got nil error, want one")
+	}
+}
+
+func TestBuildHTTPClientAllowsInsecureSkipVerifyFromAllowList(t *testing.T) {
+	insecureServicesAllowList["allow-listed"] = true
+	defer delete(insecureServicesAllowList, "allow-listed")
+
+	client, err := buildHTTPClient(&Service{Name: "allow-listed", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("buildHTTPClient() error = %v", err)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("client.Transport = %T, want *http.Transport", client.Transport)
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("TLSClientConfig.InsecureSkipVerify = false, want true")
+	}
+}
+
+func TestBuildHTTPClientRejectsUnparsableProxy(t *testing.T) {
+	_, err := buildHTTPClient(&Service{Name: "bad-proxy", HTTPProxy: "://not-a-url"})
+	if err == nil {
+		t.Fatal("buildHTTPClient() with an unparsable HTTPProxy: got nil error, want one")
+	}
+}
@@ -0,0 +1,328 @@
+package integram
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/requilence/jobs"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// JobState represents the lifecycle state of a scheduled job
+type JobState int8
+
+const (
+	// JobPending is the implied state of a job that has no persisted record yet; it is never stored
+	// itself, so a job's first persisted transition is Pending -> Scheduled
+	JobPending JobState = iota
+	// JobScheduled means the job is queued and waiting for its NextTime
+	JobScheduled
+	// JobRunning means the job's handler is currently executing
+	JobRunning
+	// JobRetrying means the job failed but has retries left and will run again
+	JobRetrying
+	// JobSucceeded is a terminal state for a job that finished without error
+	JobSucceeded
+	// JobFailed is a terminal state for a job that exhausted its retries
+	JobFailed
+	// JobDead is a terminal state for a job that can't transition any further (e.g. corrupted state)
+	JobDead
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobPending:
+		return "pending"
+	case JobScheduled:
+		return "scheduled"
+	case JobRunning:
+		return "running"
+	case JobRetrying:
+		return "retrying"
+	case JobSucceeded:
+		return "succeeded"
+	case JobFailed:
+		return "failed"
+	case JobDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// jobStateTransitions is the table of allowed state transitions, enforced in beforeJob/afterJob
+var jobStateTransitions = map[JobState][]JobState{
+	JobPending:   {JobScheduled, JobDead},
+	JobScheduled: {JobRunning, JobDead},
+	JobRunning:   {JobSucceeded, JobFailed, JobRetrying, JobDead},
+	JobRetrying:  {JobScheduled, JobRunning, JobDead},
+	JobSucceeded: {},
+	JobFailed:    {JobDead}, // lets an operator mark an exhausted job Dead instead of retrying it
+	JobDead:      {},
+}
+
+func canTransitionJobState(from, to JobState) bool {
+	for _, allowed := range jobStateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// jobStateCollection is the Mongo collection used to persist each job's current state
+const jobStateCollection = "jobStates"
+
+// jobStateHistoryCollection is the Mongo collection holding an append-only entry per transition, so
+// JobStore.History can show the full Pending->...->current path instead of just the latest hop
+const jobStateHistoryCollection = "jobStateHistory"
+
+// jobStateTerminalTTL is how long a terminated job's record is kept around for introspection
+const jobStateTerminalTTL = 7 * 24 * time.Hour
+
+// JobStateRecord is the persisted history entry for a single job's state transition
+type JobStateRecord struct {
+	Service     string    `bson:"service"`
+	JobID       string    `bson:"jobID"`
+	JobName     string    `bson:"jobName,omitempty"`
+	State       JobState  `bson:"state"`
+	PrevState   JobState  `bson:"prevState"`
+	Error       string    `bson:"error,omitempty"`
+	RetriesLeft uint      `bson:"retriesLeft"`
+	NextRun     time.Time `bson:"nextRun,omitempty"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+	ExpireAt    time.Time `bson:"expireAt,omitempty"`
+	// Args is the gob-encoded handler arguments captured when the job was first scheduled, kept
+	// around so JobStore.Retry can re-enqueue a failed/dead job with the same arguments.
+	Args []byte `bson:"args,omitempty"`
+}
+
+// encodeJobArgs gob-encodes a job's handler arguments for storage on its JobStateRecord.
+// Types must already be gob.Register'd, which Register does for every job's argument types.
+func encodeJobArgs(args []interface{}) []byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&args); err != nil {
+		log.WithError(err).Warn("Can't encode job args for retry persistence")
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decodeJobArgs reverses encodeJobArgs. A nil/empty data returns a nil slice, not an error.
+func decodeJobArgs(data []byte) ([]interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var args []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func ensureJobStateIndexes(db *mgo.Database) error {
+	c := db.C(jobStateCollection)
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"service", "jobID"}, Unique: true}); err != nil {
+		return err
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"expireAt"}, ExpireAfter: time.Second}); err != nil {
+		return err
+	}
+
+	h := db.C(jobStateHistoryCollection)
+	if err := h.EnsureIndex(mgo.Index{Key: []string{"service", "jobID", "updatedAt"}}); err != nil {
+		return err
+	}
+	return h.EnsureIndex(mgo.Index{Key: []string{"expireAt"}, ExpireAfter: time.Second})
+}
+
+// transitionJobState validates and persists a job state transition, keyed by service+jobID.
+// Terminal states (JobSucceeded, JobFailed, JobDead) get an expireAt so Mongo's TTL index reaps them.
+// jobName and args are only needed on the first (Scheduled) transition; pass "" and nil afterwards
+// and the previous record's values carry forward, so JobStore.Retry can still find them later.
+func transitionJobState(service string, jobID string, to JobState, jobErr error, retriesLeft uint, nextRun time.Time, jobName string, args []byte) error {
+	s := mongoSession.Clone()
+	defer s.Close()
+
+	db := s.DB(mongo.Database)
+	c := db.C(jobStateCollection)
+
+	prev := JobStateRecord{State: JobPending}
+	err := c.Find(bson.M{"service": service, "jobID": jobID}).One(&prev)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	if !canTransitionJobState(prev.State, to) {
+		return fmt.Errorf("job_state: invalid transition %s -> %s for %s/%s", prev.State, to, service, jobID)
+	}
+
+	if jobName == "" {
+		jobName = prev.JobName
+	}
+	if args == nil {
+		args = prev.Args
+	}
+
+	record := JobStateRecord{
+		Service:     service,
+		JobID:       jobID,
+		JobName:     jobName,
+		State:       to,
+		PrevState:   prev.State,
+		RetriesLeft: retriesLeft,
+		NextRun:     nextRun,
+		UpdatedAt:   time.Now(),
+		Args:        args,
+	}
+	if jobErr != nil {
+		record.Error = jobErr.Error()
+	}
+
+	switch to {
+	case JobSucceeded, JobFailed, JobDead:
+		record.ExpireAt = record.UpdatedAt.Add(jobStateTerminalTTL)
+	}
+
+	_, err = c.Upsert(bson.M{"service": service, "jobID": jobID}, record)
+	if err != nil {
+		log.WithFields(log.Fields{"service": service, "jobID": jobID, "state": to}).WithError(err).Error("Can't persist job state transition")
+		return err
+	}
+
+	// The history entry is supplementary to the current-state record above, so a failure to insert
+	// it is logged but doesn't fail the transition itself.
+	historyEntry := record
+	historyEntry.ExpireAt = record.UpdatedAt.Add(jobStateTerminalTTL)
+	if herr := db.C(jobStateHistoryCollection).Insert(historyEntry); herr != nil {
+		log.WithFields(log.Fields{"service": service, "jobID": jobID, "state": to}).WithError(herr).Warn("Can't persist job state history entry")
+	}
+
+	return nil
+}
+
+// JobStateByID returns the current persisted state of a job, for admin/introspection purposes
+func JobStateByID(service string, jobID string) (*JobStateRecord, error) {
+	s := mongoSession.Clone()
+	defer s.Close()
+
+	record := &JobStateRecord{}
+	err := s.DB(mongo.Database).C(jobStateCollection).Find(bson.M{"service": service, "jobID": jobID}).One(record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// JobStates returns all persisted job records for a service, optionally filtered by state.
+// Pass -1 to get jobs in any state.
+func JobStates(service string, state JobState) ([]JobStateRecord, error) {
+	s := mongoSession.Clone()
+	defer s.Close()
+
+	q := bson.M{"service": service}
+	if state >= 0 {
+		q["state"] = state
+	}
+
+	var records []JobStateRecord
+	err := s.DB(mongo.Database).C(jobStateCollection).Find(q).Sort("-updatedAt").All(&records)
+	return records, err
+}
+
+// JobHistory returns the append-only transition history for a single job, oldest first. Unlike
+// JobStateByID (which only has the current record, overwritten on every transition), this shows the
+// full Pending->...->current path.
+func JobHistory(service string, jobID string) ([]JobStateRecord, error) {
+	s := mongoSession.Clone()
+	defer s.Close()
+
+	var records []JobStateRecord
+	err := s.DB(mongo.Database).C(jobStateHistoryCollection).Find(bson.M{"service": service, "jobID": jobID}).Sort("updatedAt").All(&records)
+	return records, err
+}
+
+// JobStore gives operators list/inspect/retry/cancel access to one service's persisted jobs.
+// Get it via Service.JobStore(); the admin HTTP API (see admin.go) is a thin wrapper around it.
+type JobStore struct {
+	service string
+}
+
+// JobStore returns the job introspection/control API for this service's persisted job states.
+func (s *Service) JobStore() *JobStore {
+	return &JobStore{service: s.Name}
+}
+
+// List returns the service's persisted job records, optionally filtered by state.
+// Pass -1 to get jobs in any state.
+func (j *JobStore) List(state JobState) ([]JobStateRecord, error) {
+	return JobStates(j.service, state)
+}
+
+// Get returns the persisted record for a single job, by ID.
+func (j *JobStore) Get(jobID string) (*JobStateRecord, error) {
+	return JobStateByID(j.service, jobID)
+}
+
+// History returns a single job's full transition history, oldest first.
+func (j *JobStore) History(jobID string) ([]JobStateRecord, error) {
+	return JobHistory(j.service, jobID)
+}
+
+// Retry re-enqueues a Failed or Dead job as a new job, with the arguments it was originally scheduled
+// with. The new job gets its own ID and its own record, starting in JobScheduled; the original
+// record keeps its Failed/Dead state. It fails if the job's type is no longer registered (e.g. the
+// service was redeployed without that handler) or its args can't be decoded.
+func (j *JobStore) Retry(jobID string) (*jobs.Job, error) {
+	record, err := JobStateByID(j.service, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if record.State != JobFailed && record.State != JobDead {
+		return nil, fmt.Errorf("job_state: job %s/%s is %s, only failed/dead jobs can be retried", j.service, jobID, record.State)
+	}
+
+	jobType, ok := jobsPerService[j.service][record.JobName]
+	if !ok {
+		return nil, fmt.Errorf("job_state: unknown job type %q for service %s", record.JobName, j.service)
+	}
+
+	args, err := decodeJobArgs(record.Args)
+	if err != nil {
+		return nil, fmt.Errorf("job_state: can't decode stored args for %s/%s: %v", j.service, jobID, err)
+	}
+
+	job, err := jobType.Schedule(0, time.Now(), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	jobRuns.Lock()
+	jobRuns.m[job.Id()] = jobRun{name: record.JobName}
+	jobRuns.Unlock()
+
+	if terr := transitionJobState(j.service, job.Id(), JobScheduled, nil, job.Retries(), time.Now(), record.JobName, record.Args); terr != nil {
+		log.WithFields(log.Fields{"service": j.service, "jobID": job.Id()}).WithError(terr).Error("Can't transition retried job to scheduled")
+	}
+	return job, nil
+}
+
+// Cancel marks a Failed job Dead so it's no longer eligible for retry. It only accepts jobs already
+// in a terminal-ish Failed state: the jobs package exposes no way to dequeue/stop a job that's still
+// Pending/Scheduled/Running/Retrying, so cancelling one of those would just race afterJob's own
+// terminal transition once the job actually finishes (afterJob would then try an illegal
+// Dead -> Succeeded/Failed/Retrying move). Cancel is therefore "give up on retrying this" bookkeeping,
+// not a real stop.
+func (j *JobStore) Cancel(jobID string) error {
+	record, err := JobStateByID(j.service, jobID)
+	if err != nil {
+		return err
+	}
+	if record.State != JobFailed {
+		return fmt.Errorf("job_state: can't cancel job %s/%s from state %s; only failed jobs can be marked dead (this does not stop in-flight work)", j.service, jobID, record.State)
+	}
+	return transitionJobState(j.service, jobID, JobDead, fmt.Errorf("cancelled by admin"), 0, time.Time{}, record.JobName, record.Args)
+}
@@ -0,0 +1,60 @@
+package integram
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+func init() {
+	gob.Register("")
+	gob.Register(0)
+}
+
+func TestCanTransitionJobState(t *testing.T) {
+	cases := []struct {
+		from, to JobState
+		want     bool
+	}{
+		{JobPending, JobScheduled, true},
+		{JobPending, JobRunning, false},
+		{JobScheduled, JobRunning, true},
+		{JobRunning, JobSucceeded, true},
+		{JobRunning, JobPending, false},
+		{JobFailed, JobDead, true}, // operators can mark an exhausted job Dead
+		{JobFailed, JobScheduled, false},
+		{JobSucceeded, JobDead, false},
+		{JobDead, JobScheduled, false},
+	}
+
+	for _, c := range cases {
+		if got := canTransitionJobState(c.from, c.to); got != c.want {
+			t.Errorf("canTransitionJobState(%s, %s) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestEncodeDecodeJobArgs(t *testing.T) {
+	args := []interface{}{"owner/repo", 42}
+	encoded := encodeJobArgs(args)
+	if len(encoded) == 0 {
+		t.Fatal("encodeJobArgs() returned empty data for non-empty args")
+	}
+
+	decoded, err := decodeJobArgs(encoded)
+	if err != nil {
+		t.Fatalf("decodeJobArgs() error = %v", err)
+	}
+	if len(decoded) != len(args) {
+		t.Fatalf("decodeJobArgs() = %v, want %v", decoded, args)
+	}
+}
+
+func TestDecodeJobArgsEmpty(t *testing.T) {
+	decoded, err := decodeJobArgs(nil)
+	if err != nil {
+		t.Fatalf("decodeJobArgs(nil) error = %v", err)
+	}
+	if decoded != nil {
+		t.Fatalf("decodeJobArgs(nil) = %v, want nil", decoded)
+	}
+}
@@ -0,0 +1,72 @@
+// Package metrics exposes Prometheus collectors for the hot paths of the integram package:
+// jobs, webhook deliveries and Telegram update handling. Serve them with Listen, or scrape
+// promhttp.Handler() directly if the host process already runs its own HTTP server.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// JobsTotal counts finished job runs by service, job name and the status the run ended in (succeeded/failed/retrying)
+	JobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "integram",
+		Name:      "jobs_total",
+		Help:      "Total number of jobs processed, by service, job and status",
+	}, []string{"service", "job", "status"})
+
+	// JobDuration observes the wall time a job spent executing, between beforeJob and afterJob
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "integram",
+		Name:      "job_duration_seconds",
+		Help:      "Job execution time in seconds, by service and job",
+	}, []string{"service", "job"})
+
+	// JobsInflight gauges jobs currently being executed by a service's pool middleware
+	JobsInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "integram",
+		Name:      "jobs_inflight",
+		Help:      "Number of jobs currently executing, by service",
+	}, []string{"service"})
+
+	// WebhooksTotal counts inbound webhook deliveries handled by Service.WebhookHandler, by service and outcome
+	WebhooksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "integram",
+		Name:      "webhooks_total",
+		Help:      "Total number of webhook deliveries handled, by service and status",
+	}, []string{"service", "status"})
+
+	// TGUpdatesTotal counts Telegram updates dispatched to a service's handlers, by service, update type and outcome
+	TGUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "integram",
+		Name:      "tg_updates_total",
+		Help:      "Total number of Telegram updates handled, by service, update type and status",
+	}, []string{"service", "type", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(JobsTotal, JobDuration, JobsInflight, WebhooksTotal, TGUpdatesTotal)
+}
+
+// ServiceMetrics returns a Registerer that attaches the given service name as a "service" label to
+// every collector registered through it, so a service's custom collectors carry the same label as
+// the built-in per-service metrics without any extra plumbing, e.g.:
+//
+//	metrics.ServiceMetrics("github").MustRegister(myCustomCollector)
+func ServiceMetrics(service string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"service": service}, prometheus.DefaultRegisterer)
+}
+
+// Listen starts an HTTP server exposing /metrics via promhttp.Handler(). Intended to be called
+// once at startup with the INTEGRAM_METRICS_ADDR value; a blank addr disables it.
+func Listen(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
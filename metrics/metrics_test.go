@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServiceMetricsAttachesServiceLabel(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "integram_metrics_test_total",
+		Help: "test-only counter registered through ServiceMetrics",
+	})
+	counter.Inc()
+
+	if err := ServiceMetrics("github").Register(counter); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	defer prometheus.DefaultRegisterer.Unregister(counter)
+
+	got, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "integram_metrics_test_total")
+	if err != nil {
+		t.Fatalf("GatherAndCount() error = %v", err)
+	}
+	if got != 1 {
+		t.Fatalf("got %d samples for integram_metrics_test_total, want 1", got)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "integram_metrics_test_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			found := false
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "service" && label.GetValue() == "github" {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("metric labels = %v, want a service=\"github\" label", m.GetLabel())
+			}
+		}
+	}
+}
+
+func TestServiceMetricsRejectsDuplicateRegistration(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "integram_metrics_test_dup_total",
+		Help: "test-only counter to exercise duplicate registration",
+	})
+	if err := ServiceMetrics("jira").Register(counter); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	defer prometheus.DefaultRegisterer.Unregister(counter)
+
+	if err := ServiceMetrics("jira").Register(counter); err == nil {
+		t.Fatal("Register() on an already-registered collector: got nil error, want AlreadyRegisteredError")
+	} else if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+		t.Fatalf("Register() error = %v, want an already-registered error", err)
+	}
+}
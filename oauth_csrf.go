@@ -0,0 +1,217 @@
+package integram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// oauthStateTTL bounds how long a signed OAuth state param is valid for, from redirect to callback
+const oauthStateTTL = 10 * time.Minute
+
+// oauthCSRFCookieName is the cookie set on the initiating redirect and checked on callback, binding
+// the browser session that started the OAuth flow to the one that completes it
+const oauthCSRFCookieName = "integram_oauth_csrf"
+
+// csrfSecret derives the HMAC key for OAuth state signing from INTEGRAM_CSRF_SECRET.
+// It's read once; an empty env var means every signature will be rejected by a reader that
+// computes its own (different, random-seeded) key, so operators must set it in production.
+var csrfSecret = func() []byte {
+	secret := os.Getenv("INTEGRAM_CSRF_SECRET")
+	if secret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		secret = base64.StdEncoding.EncodeToString(b)
+		log.Warn("INTEGRAM_CSRF_SECRET is not set, using a random per-process key. Set it explicitly in production so OAuth state survives restarts/multiple instances.")
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}()
+
+// oauthState is the payload signed into the OAuth "state" redirect param
+type oauthState struct {
+	UserID  int64
+	ChatID  int64
+	Service string
+	Nonce   string
+	Expiry  int64
+}
+
+func (s *oauthState) payload() string {
+	return fmt.Sprintf("%d|%d|%s|%s|%d", s.UserID, s.ChatID, s.Service, s.Nonce, s.Expiry)
+}
+
+func signOAuthStatePayload(payload string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signOAuthState builds the signed, time-bounded state param for an OAuth redirect: an HMAC-SHA256
+// over userID|chatID|service|nonce|expiry, keyed off INTEGRAM_CSRF_SECRET
+func signOAuthState(userID int64, chatID int64, service string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+
+	state := &oauthState{
+		UserID:  userID,
+		ChatID:  chatID,
+		Service: service,
+		Nonce:   hex.EncodeToString(nonceBytes),
+		Expiry:  time.Now().Add(oauthStateTTL).Unix(),
+	}
+
+	payload := state.payload()
+	signature := signOAuthStatePayload(payload)
+
+	return base64.URLEncoding.EncodeToString([]byte(payload)) + "." + signature, nil
+}
+
+// verifyOAuthState checks the signature and expiry of a state param received on an OAuth callback,
+// and rejects it as a replay if its nonce has already been consumed once before
+func verifyOAuthState(state string) (*oauthState, error) {
+	parts := strings.SplitN(state, ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("oauth state: malformed")
+	}
+
+	payloadBytes, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("oauth state: can't decode payload: %v", err)
+	}
+	payload := string(payloadBytes)
+
+	expectedSignature := signOAuthStatePayload(payload)
+	if subtle.ConstantTimeCompare([]byte(expectedSignature), []byte(parts[1])) != 1 {
+		return nil, fmt.Errorf("oauth state: signature mismatch")
+	}
+
+	fields := strings.SplitN(payload, "|", 5)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("oauth state: malformed payload")
+	}
+
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("oauth state: bad userID: %v", err)
+	}
+	chatID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("oauth state: bad chatID: %v", err)
+	}
+	expiry, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("oauth state: bad expiry: %v", err)
+	}
+	if time.Now().Unix() > expiry {
+		return nil, fmt.Errorf("oauth state: expired")
+	}
+
+	parsed := &oauthState{
+		UserID:  userID,
+		ChatID:  chatID,
+		Service: fields[2],
+		Nonce:   fields[3],
+		Expiry:  expiry,
+	}
+
+	if !acquireOAuthNonce(parsed.Nonce) {
+		return nil, fmt.Errorf("oauth state: nonce already used, possible replay")
+	}
+
+	return parsed, nil
+}
+
+// acquireOAuthNonce claims a state's nonce in Redis so it can only ever be redeemed once. Returns
+// false if the nonce was already seen (a replay). If Redis itself can't be reached, it fails open
+// (returns true) rather than rejecting every legitimate OAuth callback for every service during a
+// Redis outage; a state is still bound by its signature and TTL even without replay protection.
+func acquireOAuthNonce(nonce string) bool {
+	c := redisPool.Get()
+	defer c.Close()
+
+	reply, err := redis.String(c.Do("SET", "integram:oauth_nonce:"+nonce, "1", "NX", "EX", int(oauthStateTTL.Seconds())))
+	if err != nil {
+		if err == redis.ErrNil {
+			return false
+		}
+		log.WithError(err).Warn("Can't reach Redis for OAuth nonce check, allowing the callback anyway (failing open)")
+		return true
+	}
+	return reply == "OK"
+}
+
+// setOAuthCSRFCookie sets the CSRF cookie on the OAuth-initiating redirect response, binding it to
+// the signed state so the callback can confirm the same browser session started the flow
+func setOAuthCSRFCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCSRFCookieName,
+		Value:    signOAuthStatePayload(state),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(oauthStateTTL),
+	})
+}
+
+// checkOAuthCSRFCookie verifies the CSRF cookie on an OAuth callback request matches the state
+// param that was signed on the initiating redirect
+func checkOAuthCSRFCookie(r *http.Request, state string) error {
+	cookie, err := r.Cookie(oauthCSRFCookieName)
+	if err != nil {
+		return fmt.Errorf("oauth csrf: missing cookie: %v", err)
+	}
+
+	expected := signOAuthStatePayload(state)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(cookie.Value)) != 1 {
+		return fmt.Errorf("oauth csrf: cookie mismatch")
+	}
+	return nil
+}
+
+// SignOAuthRedirect builds the signed, time-bounded state param for this service's OAuth redirect
+// and sets the matching CSRF cookie on w, binding the browser session that starts the flow to the
+// one that completes it. This is called from wherever the OAuth authorize URL is actually built
+// (the handler that redirects the user to OAuthProvider's authorize endpoint) and the result passed
+// as the "state" query param - that handler lives outside this package's trimmed-down job/oauth
+// core. verifyOAuthCallback unconditionally checks both the signature and this cookie on callback,
+// so skipping this call means every real OAuth login will be rejected at the callback.
+func (s *Service) SignOAuthRedirect(w http.ResponseWriter, userID int64, chatID int64) (string, error) {
+	state, err := signOAuthState(userID, chatID, s.Name)
+	if err != nil {
+		return "", err
+	}
+	setOAuthCSRFCookie(w, state)
+	return state, nil
+}
+
+// verifyOAuthCallback checks the signed "state" query param on an OAuth callback request against
+// both its own signature/expiry/replay protection and the CSRF cookie set on the initiating
+// redirect. It must succeed before AccessTokenReceiver is invoked.
+func verifyOAuthCallback(r *http.Request) (*oauthState, error) {
+	state := r.URL.Query().Get("state")
+
+	parsed, err := verifyOAuthState(state)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOAuthCSRFCookie(r, state); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
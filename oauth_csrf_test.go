@@ -0,0 +1,158 @@
+package integram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type csrfTestServicer struct{ s *Service }
+
+func (t csrfTestServicer) Service() *Service { return t.s }
+
+func TestSignAndVerifyOAuthStateRoundTrip(t *testing.T) {
+	state, err := signOAuthState(1, 2, "github")
+	if err != nil {
+		t.Fatalf("signOAuthState() error = %v", err)
+	}
+
+	parsed, err := verifyOAuthState(state)
+	if err != nil {
+		t.Fatalf("verifyOAuthState() error = %v", err)
+	}
+	if parsed.UserID != 1 || parsed.ChatID != 2 || parsed.Service != "github" {
+		t.Fatalf("verifyOAuthState() = %+v, want UserID=1 ChatID=2 Service=github", parsed)
+	}
+}
+
+func TestVerifyOAuthStateRejectsTamperedSignature(t *testing.T) {
+	state, err := signOAuthState(1, 2, "github")
+	if err != nil {
+		t.Fatalf("signOAuthState() error = %v", err)
+	}
+
+	tampered := state[:len(state)-1] + "0"
+	if tampered == state {
+		tampered = state[:len(state)-1] + "1"
+	}
+
+	if _, err := verifyOAuthState(tampered); err == nil {
+		t.Fatal("verifyOAuthState() on a tampered state: got nil error, want one")
+	}
+}
+
+func TestVerifyOAuthStateRejectsMalformed(t *testing.T) {
+	if _, err := verifyOAuthState("not-a-valid-state"); err == nil {
+		t.Fatal("verifyOAuthState() on a malformed state: got nil error, want one")
+	}
+}
+
+func TestOAuthCSRFCookieRoundTrip(t *testing.T) {
+	state, err := signOAuthState(1, 2, "github")
+	if err != nil {
+		t.Fatalf("signOAuthState() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	setOAuthCSRFCookie(rec, state)
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	if err := checkOAuthCSRFCookie(req, state); err != nil {
+		t.Fatalf("checkOAuthCSRFCookie() error = %v", err)
+	}
+}
+
+func TestOAuthCSRFCookieRejectsMissingCookie(t *testing.T) {
+	state, err := signOAuthState(1, 2, "github")
+	if err != nil {
+		t.Fatalf("signOAuthState() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	if err := checkOAuthCSRFCookie(req, state); err == nil {
+		t.Fatal("checkOAuthCSRFCookie() with no cookie set: got nil error, want one")
+	}
+}
+
+func TestVerifyOAuthCallbackRequiresMatchingCookie(t *testing.T) {
+	s := &Service{Name: "github"}
+
+	rec := httptest.NewRecorder()
+	state, err := s.SignOAuthRedirect(rec, 1, 2)
+	if err != nil {
+		t.Fatalf("SignOAuthRedirect() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	if _, err := verifyOAuthCallback(req); err != nil {
+		t.Fatalf("verifyOAuthCallback() with a matching cookie error = %v", err)
+	}
+
+	// A fresh state, so the rejection below comes from the missing cookie and not from nonce replay.
+	freshState, err := s.SignOAuthRedirect(httptest.NewRecorder(), 1, 2)
+	if err != nil {
+		t.Fatalf("SignOAuthRedirect() error = %v", err)
+	}
+	reqNoCookie := httptest.NewRequest(http.MethodGet, "/callback?state="+freshState, nil)
+	if _, err := verifyOAuthCallback(reqNoCookie); err == nil {
+		t.Fatal("verifyOAuthCallback() with no CSRF cookie: got nil error, want one")
+	}
+}
+
+// TestRegisterWrapsOAuth2AccessTokenReceiverWithCSRFCheck exercises the full round trip through
+// Register's wrapping, not just the standalone sign/verify helpers: a redirect signed via
+// SignOAuthRedirect must be accepted by the wrapped AccessTokenReceiver, and a callback missing the
+// CSRF cookie must be rejected before the underlying receiver ever runs.
+func TestRegisterWrapsOAuth2AccessTokenReceiverWithCSRFCheck(t *testing.T) {
+	receiverCalled := false
+	service := &Service{
+		Name: "github-csrf-test",
+		DefaultOAuth2: &DefaultOAuth2{
+			AccessTokenReceiver: func(serviceContext *Context, r *http.Request) (string, *time.Time, string, error) {
+				receiverCalled = true
+				return "token", nil, "", nil
+			},
+		},
+	}
+	Register(csrfTestServicer{s: service}, "")
+
+	rec := httptest.NewRecorder()
+	state, err := service.SignOAuthRedirect(rec, 1, 2)
+	if err != nil {
+		t.Fatalf("SignOAuthRedirect() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	if _, _, _, err := service.DefaultOAuth2.AccessTokenReceiver(nil, req); err != nil {
+		t.Fatalf("wrapped AccessTokenReceiver() with a matching cookie error = %v", err)
+	}
+	if !receiverCalled {
+		t.Fatal("wrapped AccessTokenReceiver() didn't call through to the underlying receiver")
+	}
+
+	receiverCalled = false
+	// A fresh state, so the rejection below comes from the missing cookie and not from nonce replay.
+	freshState, err := service.SignOAuthRedirect(httptest.NewRecorder(), 1, 2)
+	if err != nil {
+		t.Fatalf("SignOAuthRedirect() error = %v", err)
+	}
+	reqNoCookie := httptest.NewRequest(http.MethodGet, "/callback?state="+freshState, nil)
+	if _, _, _, err := service.DefaultOAuth2.AccessTokenReceiver(nil, reqNoCookie); err == nil {
+		t.Fatal("wrapped AccessTokenReceiver() with no CSRF cookie: got nil error, want one")
+	}
+	if receiverCalled {
+		t.Fatal("wrapped AccessTokenReceiver() called the underlying receiver despite a missing CSRF cookie")
+	}
+}
@@ -0,0 +1,314 @@
+package integram
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OAuthToken is a stored OAuth1/OAuth2 credential for a single user+service pair.
+// Secret holds the OAuth1 token secret or the OAuth2 refresh token, depending on the service.
+type OAuthToken struct {
+	Service   string     `bson:"service"`
+	UserID    int64      `bson:"userID"`
+	Access    string     `bson:"access"`
+	Secret    string     `bson:"secret,omitempty"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty"`
+}
+
+// OAuthClient is a registered OAuth1/OAuth2 application (a.k.a. consumer) for a service.
+type OAuthClient struct {
+	Service      string `bson:"service"`
+	ClientID     string `bson:"clientID"`
+	ClientSecret string `bson:"clientSecret"`
+}
+
+// OAuthTokenStore persists per-user OAuth tokens. Implementations must be safe for concurrent use.
+type OAuthTokenStore interface {
+	GetByUserID(service string, userID int64) (*OAuthToken, error)
+	Set(token *OAuthToken) error
+	DeleteByAccess(service string, access string) error
+}
+
+// OAuthClientStore persists OAuth client app credentials.
+type OAuthClientStore interface {
+	GetByClientID(service string, clientID string) (*OAuthClient, error)
+	Set(client *OAuthClient) error
+}
+
+// mongoOAuthTokenStore is the default OAuthTokenStore, backed by the embedded Mongo instance.
+// It's what every service got implicitly before TokenStore became pluggable.
+type mongoOAuthTokenStore struct{}
+
+func (mongoOAuthTokenStore) c() *mgo.Collection {
+	return mongoSession.Clone().DB(mongo.Database).C("oauthTokens")
+}
+
+func (s mongoOAuthTokenStore) GetByUserID(service string, userID int64) (*OAuthToken, error) {
+	c := s.c()
+	defer c.Database.Session.Close()
+
+	token := &OAuthToken{}
+	err := c.Find(bson.M{"service": service, "userID": userID}).One(token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s mongoOAuthTokenStore) Set(token *OAuthToken) error {
+	c := s.c()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"service": token.Service, "userID": token.UserID}, token)
+	return err
+}
+
+func (s mongoOAuthTokenStore) DeleteByAccess(service string, access string) error {
+	c := s.c()
+	defer c.Database.Session.Close()
+
+	return c.Remove(bson.M{"service": service, "access": access})
+}
+
+// mongoOAuthClientStore is the default OAuthClientStore, backed by the embedded Mongo instance.
+type mongoOAuthClientStore struct{}
+
+func (mongoOAuthClientStore) c() *mgo.Collection {
+	return mongoSession.Clone().DB(mongo.Database).C("oauthClients")
+}
+
+func (s mongoOAuthClientStore) GetByClientID(service string, clientID string) (*OAuthClient, error) {
+	c := s.c()
+	defer c.Database.Session.Close()
+
+	client := &OAuthClient{}
+	err := c.Find(bson.M{"service": service, "clientID": clientID}).One(client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s mongoOAuthClientStore) Set(client *OAuthClient) error {
+	c := s.c()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"service": client.Service, "clientID": client.ClientID}, client)
+	return err
+}
+
+// redisOAuthTokenStore is an alternate OAuthTokenStore for deployments that don't want Mongo to be
+// the source of truth for credentials. It uses this package's redisPool (see cron.go, dialled from
+// INTEGRAM_REDIS_URL), not the jobs package's own connection pool.
+type redisOAuthTokenStore struct{}
+
+func redisOAuthTokenKey(service string, userID int64) string {
+	return fmt.Sprintf("integram:oauth_token:%s:%d", service, userID)
+}
+
+func (redisOAuthTokenStore) GetByUserID(service string, userID int64) (*OAuthToken, error) {
+	c := redisPool.Get()
+	defer c.Close()
+
+	b, err := redis.Bytes(c.Do("GET", redisOAuthTokenKey(service, userID)))
+	if err != nil {
+		return nil, err
+	}
+
+	token := &OAuthToken{}
+	if err := bson.Unmarshal(b, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (redisOAuthTokenStore) Set(token *OAuthToken) error {
+	b, err := bson.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	c := redisPool.Get()
+	defer c.Close()
+
+	_, err = c.Do("SET", redisOAuthTokenKey(token.Service, token.UserID), b)
+	return err
+}
+
+func (redisOAuthTokenStore) DeleteByAccess(service string, access string) error {
+	// Redis has no secondary index on access token, so this store only supports lookup by userID.
+	return fmt.Errorf("redisOAuthTokenStore: DeleteByAccess is not supported, delete by userID instead")
+}
+
+// NewRedisOAuthTokenStore returns an OAuthTokenStore backed by the same Redis pool cron locking
+// uses (redisPool, not the jobs package's pool). Select it via Service.TokenStore for deployments that don't want
+// Mongo to be the source of truth for credentials. Note DeleteByAccess isn't supported by this
+// store, see redisOAuthTokenStore.DeleteByAccess.
+func NewRedisOAuthTokenStore() OAuthTokenStore {
+	return redisOAuthTokenStore{}
+}
+
+// memoryOAuthTokenStore is an in-memory OAuthTokenStore, useful for tests.
+type memoryOAuthTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*OAuthToken
+}
+
+func newMemoryOAuthTokenStore() *memoryOAuthTokenStore {
+	return &memoryOAuthTokenStore{tokens: make(map[string]*OAuthToken)}
+}
+
+// NewMemoryOAuthTokenStore returns an in-memory OAuthTokenStore, useful for tests. Select it via
+// Service.TokenStore.
+func NewMemoryOAuthTokenStore() OAuthTokenStore {
+	return newMemoryOAuthTokenStore()
+}
+
+func memoryOAuthTokenKey(service string, userID int64) string {
+	return fmt.Sprintf("%s:%d", service, userID)
+}
+
+func (s *memoryOAuthTokenStore) GetByUserID(service string, userID int64) (*OAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[memoryOAuthTokenKey(service, userID)]
+	if !ok {
+		return nil, fmt.Errorf("memoryOAuthTokenStore: no token for %s/%d", service, userID)
+	}
+	return token, nil
+}
+
+func (s *memoryOAuthTokenStore) Set(token *OAuthToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[memoryOAuthTokenKey(token.Service, token.UserID)] = token
+	return nil
+}
+
+func (s *memoryOAuthTokenStore) DeleteByAccess(service string, access string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, token := range s.tokens {
+		if token.Service == service && token.Access == access {
+			delete(s.tokens, k)
+			return nil
+		}
+	}
+	return nil
+}
+
+// redisOAuthClientStore is an alternate OAuthClientStore for deployments that don't want Mongo to be
+// the source of truth for OAuth client app credentials. It uses this package's redisPool (see
+// cron.go, dialled from INTEGRAM_REDIS_URL), not the jobs package's own connection pool.
+type redisOAuthClientStore struct{}
+
+func redisOAuthClientKey(service string, clientID string) string {
+	return fmt.Sprintf("integram:oauth_client:%s:%s", service, clientID)
+}
+
+func (redisOAuthClientStore) GetByClientID(service string, clientID string) (*OAuthClient, error) {
+	c := redisPool.Get()
+	defer c.Close()
+
+	b, err := redis.Bytes(c.Do("GET", redisOAuthClientKey(service, clientID)))
+	if err != nil {
+		return nil, err
+	}
+
+	client := &OAuthClient{}
+	if err := bson.Unmarshal(b, client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (redisOAuthClientStore) Set(client *OAuthClient) error {
+	b, err := bson.Marshal(client)
+	if err != nil {
+		return err
+	}
+
+	c := redisPool.Get()
+	defer c.Close()
+
+	_, err = c.Do("SET", redisOAuthClientKey(client.Service, client.ClientID), b)
+	return err
+}
+
+// NewRedisOAuthClientStore returns an OAuthClientStore backed by the same Redis pool cron locking
+// uses (redisPool, not the jobs package's pool). Select it via Service.ClientStore for deployments that don't want
+// Mongo to be the source of truth for OAuth client app credentials.
+func NewRedisOAuthClientStore() OAuthClientStore {
+	return redisOAuthClientStore{}
+}
+
+// memoryOAuthClientStore is an in-memory OAuthClientStore, useful for tests.
+type memoryOAuthClientStore struct {
+	mu      sync.Mutex
+	clients map[string]*OAuthClient
+}
+
+func newMemoryOAuthClientStore() *memoryOAuthClientStore {
+	return &memoryOAuthClientStore{clients: make(map[string]*OAuthClient)}
+}
+
+// NewMemoryOAuthClientStore returns an in-memory OAuthClientStore, useful for tests. Select it via
+// Service.ClientStore.
+func NewMemoryOAuthClientStore() OAuthClientStore {
+	return newMemoryOAuthClientStore()
+}
+
+func memoryOAuthClientKey(service string, clientID string) string {
+	return fmt.Sprintf("%s:%s", service, clientID)
+}
+
+func (s *memoryOAuthClientStore) GetByClientID(service string, clientID string) (*OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[memoryOAuthClientKey(service, clientID)]
+	if !ok {
+		return nil, fmt.Errorf("memoryOAuthClientStore: no client %s for service %s", clientID, service)
+	}
+	return client, nil
+}
+
+func (s *memoryOAuthClientStore) Set(client *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[memoryOAuthClientKey(client.Service, client.ClientID)] = client
+	return nil
+}
+
+// SaveOAuthToken persists token through the service's TokenStore, stamping it with the service's
+// own name so callers don't have to.
+func (s *Service) SaveOAuthToken(token *OAuthToken) error {
+	token.Service = s.Name
+	return s.TokenStore.Set(token)
+}
+
+// OAuthTokenByUserID looks up the persisted OAuth token for userID through the service's TokenStore.
+func (s *Service) OAuthTokenByUserID(userID int64) (*OAuthToken, error) {
+	return s.TokenStore.GetByUserID(s.Name, userID)
+}
+
+// DeleteOAuthTokenByAccess removes the persisted OAuth token with the given access token through
+// the service's TokenStore.
+func (s *Service) DeleteOAuthTokenByAccess(access string) error {
+	return s.TokenStore.DeleteByAccess(s.Name, access)
+}
+
+// OAuthClientByID looks up the registered OAuth client app credentials through the service's
+// ClientStore.
+func (s *Service) OAuthClientByID(clientID string) (*OAuthClient, error) {
+	return s.ClientStore.GetByClientID(s.Name, clientID)
+}
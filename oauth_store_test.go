@@ -0,0 +1,104 @@
+package integram
+
+import "testing"
+
+func TestMemoryOAuthTokenStoreRoundTrip(t *testing.T) {
+	store := NewMemoryOAuthTokenStore()
+
+	token := &OAuthToken{Service: "github", UserID: 1, Access: "abc123"}
+	if err := store.Set(token); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	got, err := store.GetByUserID("github", 1)
+	if err != nil {
+		t.Fatalf("GetByUserID() error = %v", err)
+	}
+	if got.Access != token.Access {
+		t.Fatalf("GetByUserID() = %+v, want Access %q", got, token.Access)
+	}
+
+	if err := store.DeleteByAccess("github", "abc123"); err != nil {
+		t.Fatalf("DeleteByAccess() error = %v", err)
+	}
+	if _, err := store.GetByUserID("github", 1); err == nil {
+		t.Fatal("GetByUserID() after DeleteByAccess: got nil error, want one")
+	}
+}
+
+func TestMemoryOAuthTokenStoreGetByUserIDMissing(t *testing.T) {
+	store := NewMemoryOAuthTokenStore()
+	if _, err := store.GetByUserID("github", 42); err == nil {
+		t.Fatal("GetByUserID() for a token that was never set: got nil error, want one")
+	}
+}
+
+func TestServiceOAuthTokenAccessors(t *testing.T) {
+	s := &Service{Name: "github", TokenStore: NewMemoryOAuthTokenStore()}
+
+	if err := s.SaveOAuthToken(&OAuthToken{UserID: 7, Access: "xyz"}); err != nil {
+		t.Fatalf("SaveOAuthToken() error = %v", err)
+	}
+
+	got, err := s.OAuthTokenByUserID(7)
+	if err != nil {
+		t.Fatalf("OAuthTokenByUserID() error = %v", err)
+	}
+	if got.Service != "github" {
+		t.Fatalf("SaveOAuthToken() didn't stamp the service name, got %q", got.Service)
+	}
+
+	if err := s.DeleteOAuthTokenByAccess("xyz"); err != nil {
+		t.Fatalf("DeleteOAuthTokenByAccess() error = %v", err)
+	}
+	if _, err := s.OAuthTokenByUserID(7); err == nil {
+		t.Fatal("OAuthTokenByUserID() after delete: got nil error, want one")
+	}
+}
+
+func TestRedisOAuthTokenStoreDeleteByAccessUnsupported(t *testing.T) {
+	store := NewRedisOAuthTokenStore()
+	if err := store.DeleteByAccess("github", "abc123"); err == nil {
+		t.Fatal("DeleteByAccess() on the Redis store: got nil error, want one (unsupported)")
+	}
+}
+
+func TestMemoryOAuthClientStoreRoundTrip(t *testing.T) {
+	store := NewMemoryOAuthClientStore()
+
+	client := &OAuthClient{Service: "github", ClientID: "id123", ClientSecret: "secret"}
+	if err := store.Set(client); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	got, err := store.GetByClientID("github", "id123")
+	if err != nil {
+		t.Fatalf("GetByClientID() error = %v", err)
+	}
+	if got.ClientSecret != client.ClientSecret {
+		t.Fatalf("GetByClientID() = %+v, want ClientSecret %q", got, client.ClientSecret)
+	}
+}
+
+func TestMemoryOAuthClientStoreGetByClientIDMissing(t *testing.T) {
+	store := NewMemoryOAuthClientStore()
+	if _, err := store.GetByClientID("github", "missing"); err == nil {
+		t.Fatal("GetByClientID() for a client that was never set: got nil error, want one")
+	}
+}
+
+func TestServiceOAuthClientByID(t *testing.T) {
+	s := &Service{Name: "github", ClientStore: NewMemoryOAuthClientStore()}
+
+	if err := s.ClientStore.Set(&OAuthClient{Service: "github", ClientID: "id123", ClientSecret: "secret"}); err != nil {
+		t.Fatalf("ClientStore.Set() error = %v", err)
+	}
+
+	got, err := s.OAuthClientByID("id123")
+	if err != nil {
+		t.Fatalf("OAuthClientByID() error = %v", err)
+	}
+	if got.ClientSecret != "secret" {
+		t.Fatalf("OAuthClientByID() = %+v, want ClientSecret %q", got, "secret")
+	}
+}
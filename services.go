@@ -6,6 +6,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/mrjones/oauth"
+	"github.com/requilence/integram/metrics"
 	"github.com/requilence/integram/url"
 	"github.com/requilence/jobs"
 	"golang.org/x/oauth2"
@@ -13,6 +14,8 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,6 +36,18 @@ var actionFuncs = make(map[string]interface{})
 // Channel that use to recover tgUpadates reader after panic inside it
 var tgUpdatesRevoltChan = make(chan *Bot)
 
+// jobRun tracks what's needed to label/time a running job that the jobs.Job instance itself
+// doesn't expose: the registered job name and when its handler actually started executing
+type jobRun struct {
+	name    string
+	started time.Time
+}
+
+var jobRuns = struct {
+	sync.Mutex
+	m map[string]jobRun
+}{m: make(map[string]jobRun)}
+
 // Service configuration
 type Service struct {
 	Name        string // Service lowercase name
@@ -44,6 +59,16 @@ type Service struct {
 	DefaultOAuth2  *DefaultOAuth2 // Cloud(not self-hosted) app data
 	OAuthRequired  bool           // Is OAuth required in order to receive webhook updates
 
+	TokenStore  OAuthTokenStore  // Where OAuth tokens are persisted. Defaults to the Mongo-backed store if left nil
+	ClientStore OAuthClientStore // Where OAuth client app credentials are persisted. Defaults to the Mongo-backed store if left nil
+
+	InsecureSkipVerify bool   // Skip TLS cert verification for this service's outbound requests. Service name must be listed in INTEGRAM_INSECURE_SERVICES
+	CACertPEM          []byte // Extra CA cert to trust for this service's outbound requests, e.g. a self-hosted instance behind a corporate CA
+	ClientCertPEM      []byte // Client cert for mutual TLS, paired with ClientKeyPEM
+	ClientKeyPEM       []byte // Client key for mutual TLS, paired with ClientCertPEM
+	HTTPProxy          string // Outbound proxy URL to use for this service's requests, e.g. "http://proxy.local:3128"
+	httpClient         *http.Client
+
 	JobsPool int // Worker pool to be created for service. Default to 1 worker. Workers will be inited only if jobs types are available
 
 	Jobs []Job // Job types that can be scheduled
@@ -85,6 +110,9 @@ type Job struct {
 	HandlerFunc interface{} // Must be a func.
 	Retries     uint        // Number of retries before fail
 	RetryType   int         // JobRetryLinear or JobRetryFibonacci
+
+	Schedule string // Cron spec (e.g. "0 */5 * * * *"). If set, the job is enqueued automatically on that cadence instead of via DoJob/SheduleJob
+	Unique   bool   // If true, a Redis lock keyed on service+jobName makes sure clustered Integram instances don't double-fire the same tick
 }
 
 // DefaultOAuth1 is the default OAuth1 config for the service
@@ -113,6 +141,24 @@ func init() {
 	}
 	log.Debugf("BaseURL: %s", baseURL)
 
+	if metricsAddr := os.Getenv("INTEGRAM_METRICS_ADDR"); metricsAddr != "" {
+		go func() {
+			if err := metrics.Listen(metricsAddr); err != nil {
+				log.WithError(err).Errorf("Can't serve metrics on %s", metricsAddr)
+			}
+		}()
+	}
+
+	if adminAddr := os.Getenv("INTEGRAM_ADMIN_ADDR"); adminAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle(adminJobsPathPrefix, AdminHandler{})
+			if err := http.ListenAndServe(adminAddr, mux); err != nil {
+				log.WithError(err).Errorf("Can't serve admin API on %s", adminAddr)
+			}
+		}()
+	}
+
 	go func() {
 		var b *Bot
 		for {
@@ -124,6 +170,12 @@ func init() {
 		}
 	}()
 }
+
+// jobServiceName recovers the service name from a job's pool id (always "_"+service.Name, see Register)
+func jobServiceName(job *jobs.Job) string {
+	return strings.TrimPrefix(job.PoolId(), "_")
+}
+
 func afterJob(job *jobs.Job) {
 	log.Debugf("afterJob %v, poolID:%v, finished:%v\n", job.Id(), job.PoolId(), job.Finished().Unix())
 	// remove successed tasks from Redis
@@ -132,6 +184,38 @@ func afterJob(job *jobs.Job) {
 		log.WithFields(log.Fields{"jobID": job.Id(), "poolId": job.PoolId()}).WithError(err).Error("Job failed")
 	}
 
+	service := jobServiceName(job)
+
+	jobRuns.Lock()
+	run, ok := jobRuns.m[job.Id()]
+	delete(jobRuns.m, job.Id())
+	jobRuns.Unlock()
+
+	jobName := run.name
+	if !ok {
+		jobName = "unknown"
+	} else {
+		metrics.JobDuration.WithLabelValues(service, jobName).Observe(time.Since(run.started).Seconds())
+	}
+	metrics.JobsInflight.WithLabelValues(service).Dec()
+
+	if err == nil {
+		if terr := transitionJobState(service, job.Id(), JobSucceeded, nil, job.Retries(), job.NextTime(), "", nil); terr != nil {
+			log.WithFields(log.Fields{"jobID": job.Id(), "poolId": job.PoolId()}).WithError(terr).Error("Can't transition job to succeeded")
+		}
+		metrics.JobsTotal.WithLabelValues(service, jobName, JobSucceeded.String()).Inc()
+	} else if job.Retries() == 0 {
+		if terr := transitionJobState(service, job.Id(), JobFailed, err, job.Retries(), job.NextTime(), "", nil); terr != nil {
+			log.WithFields(log.Fields{"jobID": job.Id(), "poolId": job.PoolId()}).WithError(terr).Error("Can't transition job to failed")
+		}
+		metrics.JobsTotal.WithLabelValues(service, jobName, JobFailed.String()).Inc()
+	} else {
+		if terr := transitionJobState(service, job.Id(), JobRetrying, err, job.Retries(), job.NextTime(), "", nil); terr != nil {
+			log.WithFields(log.Fields{"jobID": job.Id(), "poolId": job.PoolId()}).WithError(terr).Error("Can't transition job to retrying")
+		}
+		metrics.JobsTotal.WithLabelValues(service, jobName, JobRetrying.String()).Inc()
+	}
+
 	if err == nil || job.Retries() == 0 {
 		log.Debugf("destroying the job %v finished(%v), status=%v, retriesLeft=%v, nextTime=%v", job.Id(), job.Finished(), job.Status(), job.Retries(), job.NextTime())
 		job.Destroy()
@@ -144,6 +228,17 @@ func beforeJob(ch chan bool, job *jobs.Job, args *[]reflect.Value) {
 	log.Debugf("beforeJob %v, poolID:%v, finished:%v\n", job.Id(), job.PoolId(), job.Finished().Unix())
 	s := mongoSession.Clone()
 
+	if err := transitionJobState(jobServiceName(job), job.Id(), JobRunning, nil, job.Retries(), job.NextTime(), "", nil); err != nil {
+		log.WithFields(log.Fields{"jobID": job.Id(), "poolId": job.PoolId()}).WithError(err).Error("Can't transition job to running")
+	}
+
+	jobRuns.Lock()
+	run := jobRuns.m[job.Id()]
+	run.started = time.Now()
+	jobRuns.m[job.Id()] = run
+	jobRuns.Unlock()
+	metrics.JobsInflight.WithLabelValues(jobServiceName(job)).Inc()
+
 	for i := 0; i < len(*args); i++ {
 
 		if (*args)[i].Kind() == reflect.Ptr && (*args)[i].Type().String() == "*integram.Context" {
@@ -171,6 +266,22 @@ type Servicer interface {
 // Register the service's config and corresponding botToken
 func Register(servicer Servicer, botToken string) {
 	service := servicer.Service()
+
+	if service.TokenStore == nil {
+		service.TokenStore = mongoOAuthTokenStore{}
+	}
+	if service.ClientStore == nil {
+		service.ClientStore = mongoOAuthClientStore{}
+	}
+
+	if httpClient, err := buildHTTPClient(service); err != nil {
+		log.WithField("service", service.Name).WithError(err).Panic("Can't build service HTTP client")
+	} else {
+		service.httpClient = httpClient
+	}
+
+	instrumentServiceHandlers(service)
+
 	if service.DefaultOAuth1 != nil {
 		if service.DefaultOAuth1.AccessTokenReceiver == nil {
 			err := errors.New("OAuth1 need an AccessTokenReceiver func to be specified\n")
@@ -178,9 +289,26 @@ func Register(servicer Servicer, botToken string) {
 		}
 		service.DefaultBaseURL = *URLMustParse(service.DefaultOAuth1.AccessTokenURL)
 
+		receiver := service.DefaultOAuth1.AccessTokenReceiver
+		service.DefaultOAuth1.AccessTokenReceiver = func(serviceContext *Context, r *http.Request, requestToken *oauth.RequestToken) (string, error) {
+			if _, err := verifyOAuthCallback(r); err != nil {
+				return "", err
+			}
+			return receiver(serviceContext, r, requestToken)
+		}
+
 		//mongoSession.DB(mongo.Database).C("users").EnsureIndex(mgo.Index{Key: []string{"settings." + service.Name + ".oauth_redirect_token"}})
 	} else if service.DefaultOAuth2 != nil {
 		service.DefaultBaseURL = *URLMustParse(service.DefaultOAuth2.Endpoint.AuthURL)
+
+		if receiver := service.DefaultOAuth2.AccessTokenReceiver; receiver != nil {
+			service.DefaultOAuth2.AccessTokenReceiver = func(serviceContext *Context, r *http.Request) (string, *time.Time, string, error) {
+				if _, err := verifyOAuthCallback(r); err != nil {
+					return "", nil, "", err
+				}
+				return receiver(serviceContext, r)
+			}
+		}
 	}
 	service.DefaultBaseURL.Path = ""
 	service.DefaultBaseURL.RawPath = ""
@@ -189,6 +317,12 @@ func Register(servicer Servicer, botToken string) {
 	services[service.Name] = service
 
 	if len(service.Jobs) > 0 {
+		s := mongoSession.Clone()
+		if err := ensureJobStateIndexes(s.DB(mongo.Database)); err != nil {
+			log.WithField("service", service.Name).WithError(err).Error("Can't ensure job state indexes")
+		}
+		s.Close()
+
 		if service.JobsPool == 0 {
 			service.JobsPool = 1
 		}
@@ -213,7 +347,9 @@ func Register(servicer Servicer, botToken string) {
 
 		if service.OAuthSuccessful != nil {
 			service.Jobs = append(service.Jobs, Job{
-				service.OAuthSuccessful, 10, JobRetryFibonacci,
+				HandlerFunc: service.OAuthSuccessful,
+				Retries:     10,
+				RetryType:   JobRetryFibonacci,
 			})
 		}
 		for _, job := range service.Jobs {
@@ -239,6 +375,8 @@ func Register(servicer Servicer, botToken string) {
 				jobsPerService[service.Name][jobName] = jobType
 			}
 		}
+
+		runServiceCron(service)
 	}
 	if len(service.Actions) > 0 {
 		for _, actionFunc := range service.Actions {
@@ -273,6 +411,49 @@ func Register(servicer Servicer, botToken string) {
 
 }
 
+// instrumentServiceHandlers wraps a service's webhook and Telegram handlers with the counters from
+// the metrics package, so every delivery is counted without each service author doing it themselves.
+func instrumentServiceHandlers(service *Service) {
+	if webhookHandler := service.WebhookHandler; webhookHandler != nil {
+		service.WebhookHandler = func(ctx *Context, request *WebhookContext) error {
+			err := webhookHandler(ctx, request)
+			status := "ok"
+			if err != nil {
+				status = "error"
+			}
+			metrics.WebhooksTotal.WithLabelValues(service.Name, status).Inc()
+			return err
+		}
+	}
+
+	if newMessageHandler := service.TGNewMessageHandler; newMessageHandler != nil {
+		service.TGNewMessageHandler = instrumentTGHandler(service.Name, "new_message", newMessageHandler)
+	}
+	if editMessageHandler := service.TGEditMessageHandler; editMessageHandler != nil {
+		service.TGEditMessageHandler = instrumentTGHandler(service.Name, "edit_message", editMessageHandler)
+	}
+	if inlineQueryHandler := service.TGInlineQueryHandler; inlineQueryHandler != nil {
+		service.TGInlineQueryHandler = instrumentTGHandler(service.Name, "inline_query", inlineQueryHandler)
+	}
+	if chosenInlineResultHandler := service.TGChosenInlineResultHandler; chosenInlineResultHandler != nil {
+		service.TGChosenInlineResultHandler = instrumentTGHandler(service.Name, "chosen_inline_result", chosenInlineResultHandler)
+	}
+}
+
+// instrumentTGHandler wraps a single Telegram update handler so it counts
+// integram_tg_updates_total{service, type, status} on every call.
+func instrumentTGHandler(serviceName string, updateType string, handler func(ctx *Context) error) func(ctx *Context) error {
+	return func(ctx *Context) error {
+		err := handler(ctx)
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		metrics.TGUpdatesTotal.WithLabelValues(serviceName, updateType, status).Inc()
+		return err
+	}
+}
+
 // Bot returns corresponding bot for the service
 func (s *Service) Bot() *Bot {
 	if bot, exists := botPerService[s.Name]; exists {
@@ -287,6 +468,7 @@ func (s *Service) DefaultOAuthProvider() *OAuthProvider {
 	oap := OAuthProvider{}
 	oap.BaseURL = s.DefaultBaseURL
 	oap.Service = s.Name
+	oap.HTTPClient = s.HTTPClient()
 	if s.DefaultOAuth2 != nil {
 		oap.ID = s.DefaultOAuth2.ClientID
 		oap.Secret = s.DefaultOAuth2.ClientSecret
@@ -307,8 +489,18 @@ func (s *Service) DoJob(handlerFunc interface{}, data ...interface{}) (*jobs.Job
 // SheduleJob schedules the job for specific time with specific priority. The job must be registred in Service's config (Jobs field). Arguments must be identically types with hudlerFunc's input args
 func (s *Service) SheduleJob(handlerFunc interface{}, priority int, time time.Time, data ...interface{}) (*jobs.Job, error) {
 	if jobsPerName, ok := jobsPerService[s.Name]; ok {
-		if jobType, ok := jobsPerName[getFuncName(handlerFunc)]; ok {
-			return jobType.Schedule(priority, time, data...)
+		jobName := getFuncName(handlerFunc)
+		if jobType, ok := jobsPerName[jobName]; ok {
+			job, err := jobType.Schedule(priority, time, data...)
+			if err == nil {
+				if terr := transitionJobState(s.Name, job.Id(), JobScheduled, nil, job.Retries(), time, jobName, encodeJobArgs(data)); terr != nil {
+					s.Log().WithField("jobID", job.Id()).WithError(terr).Error("Can't transition job to scheduled")
+				}
+				jobRuns.Lock()
+				jobRuns.m[job.Id()] = jobRun{name: jobName}
+				jobRuns.Unlock()
+			}
+			return job, err
 		}
 		panic("SheduleJob: Job type not found")
 	}